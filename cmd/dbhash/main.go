@@ -0,0 +1,42 @@
+// Command dbhash hashes the live critical_and_site_config schema and compares
+// it against the hash expected for the confdb binary's current schema
+// version, so that drift between migrations and the live database is caught
+// in CI rather than at runtime.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/sourcegraph/sourcegraph/pkg/db/confdb/schema"
+	"github.com/sourcegraph/sourcegraph/pkg/db/dbconn"
+)
+
+func main() {
+	dsn := flag.String("dsn", "", "PostgreSQL connection DSN for the database to hash (defaults to the standard libpq environment variables, e.g. PGHOST, PGUSER, if empty)")
+	flag.Parse()
+	ctx := context.Background()
+
+	if err := dbconn.ConnectToDB(*dsn); err != nil {
+		log.Fatalf("dbhash: connecting to the database: %v", err)
+	}
+
+	expected, err := schema.ExpectedHash(schema.CurrentVersion)
+	if err != nil {
+		log.Fatalf("dbhash: %v", err)
+	}
+
+	live, err := schema.LiveHash(ctx, dbconn.Global)
+	if err != nil {
+		log.Fatalf("dbhash: hashing live schema: %v", err)
+	}
+
+	if live != expected {
+		fmt.Printf("schema drift detected: live=%s expected=%s (schema version %d)\n", live, expected, schema.CurrentVersion)
+		log.Fatal("dbhash: live schema does not match the expected hash for this binary's schema version")
+	}
+
+	fmt.Printf("ok: live schema matches expected hash %s for schema version %d\n", expected, schema.CurrentVersion)
+}
@@ -1,3 +1,13 @@
+// Package confdb stores and serves the site and critical configuration
+// documents, including their revision history.
+//
+// TODO(confdb): the admin GraphQL resolvers that let operators browse this
+// history and trigger a rollback from the UI (ListHistory/GetByID/Diff/
+// Rollback fields on the GraphQL Site type) have not been added -- this
+// checkout doesn't contain a cmd/frontend/graphqlbackend package to wire
+// them into. SiteListHistory, SiteGetByID, SiteDiff, and SiteRollback below
+// (and their Critical* equivalents) are the confdb-level API those
+// resolvers would call; only that half of the request has been delivered.
 package confdb
 
 import (
@@ -6,20 +16,23 @@ import (
 	"fmt"
 	"time"
 
-	multierror "github.com/hashicorp/go-multierror"
-
 	"github.com/keegancsmith/sqlf"
 	"github.com/sourcegraph/jsonx"
+	"github.com/sourcegraph/sourcegraph/pkg/db/confdb/schema"
 	"github.com/sourcegraph/sourcegraph/pkg/db/dbconn"
 )
 
 // Config contains the contents of a critical/site config along with associated metadata.
 type Config struct {
-	ID        int32     // the unique ID of this config
-	Type      string    // either "critical" or "site"
-	Contents  string    // the raw JSON content (with comments and trailing commas allowed)
-	CreatedAt time.Time // the date when this config was created
-	UpdatedAt time.Time // the date when this config was updated
+	ID           int32     // the unique ID of this config
+	Type         string    // either "critical" or "site"
+	Contents     string    // the raw JSON content (with comments and trailing commas allowed)
+	CreatedAt    time.Time // the date when this config was created
+	UpdatedAt    time.Time // the date when this config was updated
+	AuthorUserID *int32    // the user who saved this revision, if known
+	Message      string    // an optional human-provided description of the change
+	ParentID     *int32    // the ID of the revision this one supersedes, if any
+	SourceRef    *string   // the git SHA this revision was ingested from, if any
 }
 
 // SiteConfig contains the contents of a site config along with associated metadata.
@@ -34,25 +47,30 @@ type CriticalConfig Config
 // The site config that was most recently saved to the database is returned.
 // An error is returned if "contents" is invalid JSON.
 //
+// authorUserID and message are recorded on the new revision for auditing
+// purposes; authorUserID may be nil if the change was not made by a user
+// (e.g. it is the initial default config).
+//
 // 🚨 SECURITY: This method does NOT verify the user is an admin. The caller is
 // responsible for ensuring this or that the response never makes it to a user.
-func SiteCreateIfUpToDate(ctx context.Context, lastID *int32, contents string) (latest *SiteConfig, err error) {
-	tx, done, err := newTransaction(ctx)
-	if err != nil {
-		return nil, err
-	}
-	defer done()
-
-	newLastID, err := addDefault(ctx, tx, typeSite, defaultSiteConfig)
-	if err != nil {
-		return nil, err
-	}
-	if newLastID != nil {
-		lastID = newLastID
-	}
+func SiteCreateIfUpToDate(ctx context.Context, lastID *int32, authorUserID *int32, message, contents string) (latest *SiteConfig, err error) {
+	err = runInNewTxn(ctx, func(tx queryable) error {
+		newLastID, err := addDefault(ctx, tx, typeSite, defaultSiteConfig)
+		if err != nil {
+			return err
+		}
+		if newLastID != nil {
+			lastID = newLastID
+		}
 
-	criticalSite, err := createIfUpToDate(ctx, tx, typeSite, lastID, contents)
-	return (*SiteConfig)(criticalSite), err
+		criticalSite, err := createIfUpToDate(ctx, tx, typeSite, lastID, authorUserID, message, contents)
+		if err != nil {
+			return err
+		}
+		latest = (*SiteConfig)(criticalSite)
+		return nil
+	})
+	return latest, err
 }
 
 // CriticalCreateIfUpToDate saves the given critical config "contents" to the
@@ -62,25 +80,30 @@ func SiteCreateIfUpToDate(ctx context.Context, lastID *int32, contents string) (
 // The critical config that was most recently saved to the database is returned.
 // An error is returned if "contents" is invalid JSON.
 //
+// authorUserID and message are recorded on the new revision for auditing
+// purposes; authorUserID may be nil if the change was not made by a user
+// (e.g. it is the initial default config).
+//
 // 🚨 SECURITY: This method does NOT verify the user is an admin. The caller is
 // responsible for ensuring this or that the response never makes it to a user.
-func CriticalCreateIfUpToDate(ctx context.Context, lastID *int32, contents string) (latest *CriticalConfig, err error) {
-	tx, done, err := newTransaction(ctx)
-	if err != nil {
-		return nil, err
-	}
-	defer done()
-
-	newLastID, err := addDefault(ctx, tx, typeCritical, defaultCriticalConfig)
-	if err != nil {
-		return nil, err
-	}
-	if newLastID != nil {
-		lastID = newLastID
-	}
+func CriticalCreateIfUpToDate(ctx context.Context, lastID *int32, authorUserID *int32, message, contents string) (latest *CriticalConfig, err error) {
+	err = runInNewTxn(ctx, func(tx queryable) error {
+		newLastID, err := addDefault(ctx, tx, typeCritical, defaultCriticalConfig)
+		if err != nil {
+			return err
+		}
+		if newLastID != nil {
+			lastID = newLastID
+		}
 
-	criticalSite, err := createIfUpToDate(ctx, tx, typeCritical, lastID, contents)
-	return (*CriticalConfig)(criticalSite), err
+		criticalSite, err := createIfUpToDate(ctx, tx, typeCritical, lastID, authorUserID, message, contents)
+		if err != nil {
+			return err
+		}
+		latest = (*CriticalConfig)(criticalSite)
+		return nil
+	})
+	return latest, err
 }
 
 // SiteGetLatest returns the site config that was most recently saved to the database.
@@ -89,19 +112,19 @@ func CriticalCreateIfUpToDate(ctx context.Context, lastID *int32, contents strin
 // 🚨 SECURITY: This method does NOT verify the user is an admin. The caller is
 // responsible for ensuring this or that the response never makes it to a user.
 func SiteGetLatest(ctx context.Context) (latest *SiteConfig, err error) {
-	tx, done, err := newTransaction(ctx)
-	if err != nil {
-		return nil, err
-	}
-	defer done()
-
-	_, err = addDefault(ctx, tx, typeSite, defaultSiteConfig)
-	if err != nil {
-		return nil, err
-	}
+	err = runInNewTxn(ctx, func(tx queryable) error {
+		if _, err := addDefault(ctx, tx, typeSite, defaultSiteConfig); err != nil {
+			return err
+		}
 
-	site, err := getLatest(ctx, tx, typeSite)
-	return (*SiteConfig)(site), err
+		site, err := getLatest(ctx, tx, typeSite)
+		if err != nil {
+			return err
+		}
+		latest = (*SiteConfig)(site)
+		return nil
+	})
+	return latest, err
 }
 
 // CriticalGetLatest returns critical site config that was most recently saved to the database.
@@ -110,37 +133,147 @@ func SiteGetLatest(ctx context.Context) (latest *SiteConfig, err error) {
 // 🚨 SECURITY: This method does NOT verify the user is an admin. The caller is
 // responsible for ensuring this or that the response never makes it to a user.
 func CriticalGetLatest(ctx context.Context) (latest *CriticalConfig, err error) {
-	tx, done, err := newTransaction(ctx)
-	if err != nil {
-		return nil, err
-	}
-	defer done()
+	err = runInNewTxn(ctx, func(tx queryable) error {
+		if _, err := addDefault(ctx, tx, typeCritical, defaultCriticalConfig); err != nil {
+			return err
+		}
 
-	_, err = addDefault(ctx, tx, typeCritical, defaultCriticalConfig)
-	if err != nil {
-		return nil, err
-	}
+		critical, err := getLatest(ctx, tx, typeCritical)
+		if err != nil {
+			return err
+		}
+		latest = (*CriticalConfig)(critical)
+		return nil
+	})
+	return latest, err
+}
+
+// SiteListHistory returns the history of site config revisions, most recent first.
+//
+// 🚨 SECURITY: This method does NOT verify the user is an admin. The caller is
+// responsible for ensuring this or that the response never makes it to a user.
+func SiteListHistory(ctx context.Context, limit, offset int) (configs []*SiteConfig, err error) {
+	err = runInNewTxn(ctx, func(tx queryable) error {
+		history, err := listHistory(ctx, tx, typeSite, limit, offset)
+		if err != nil {
+			return err
+		}
+		configs = make([]*SiteConfig, len(history))
+		for i, c := range history {
+			configs[i] = (*SiteConfig)(c)
+		}
+		return nil
+	})
+	return configs, err
+}
 
-	critical, err := getLatest(ctx, tx, typeCritical)
-	return (*CriticalConfig)(critical), err
+// CriticalListHistory returns the history of critical config revisions, most recent first.
+//
+// 🚨 SECURITY: This method does NOT verify the user is an admin. The caller is
+// responsible for ensuring this or that the response never makes it to a user.
+func CriticalListHistory(ctx context.Context, limit, offset int) (configs []*CriticalConfig, err error) {
+	err = runInNewTxn(ctx, func(tx queryable) error {
+		history, err := listHistory(ctx, tx, typeCritical, limit, offset)
+		if err != nil {
+			return err
+		}
+		configs = make([]*CriticalConfig, len(history))
+		for i, c := range history {
+			configs[i] = (*CriticalConfig)(c)
+		}
+		return nil
+	})
+	return configs, err
 }
 
-func newTransaction(ctx context.Context) (tx queryable, done func(), err error) {
-	rtx, err := dbconn.Global.BeginTx(ctx, nil)
-	if err != nil {
-		return nil, nil, err
-	}
+// SiteGetByID returns the site config revision with the given ID.
+//
+// 🚨 SECURITY: This method does NOT verify the user is an admin. The caller is
+// responsible for ensuring this or that the response never makes it to a user.
+func SiteGetByID(ctx context.Context, id int32) (config *SiteConfig, err error) {
+	err = runInNewTxn(ctx, func(tx queryable) error {
+		c, err := getByID(ctx, tx, typeSite, id)
+		if err != nil {
+			return err
+		}
+		config = (*SiteConfig)(c)
+		return nil
+	})
+	return config, err
+}
 
-	return rtx, func() {
+// CriticalGetByID returns the critical config revision with the given ID.
+//
+// 🚨 SECURITY: This method does NOT verify the user is an admin. The caller is
+// responsible for ensuring this or that the response never makes it to a user.
+func CriticalGetByID(ctx context.Context, id int32) (config *CriticalConfig, err error) {
+	err = runInNewTxn(ctx, func(tx queryable) error {
+		c, err := getByID(ctx, tx, typeCritical, id)
 		if err != nil {
-			rollErr := rtx.Rollback()
-			if rollErr != nil {
-				err = multierror.Append(err, rollErr)
-			}
-			return
+			return err
 		}
-		err = rtx.Commit()
-	}, nil
+		config = (*CriticalConfig)(c)
+		return nil
+	})
+	return config, err
+}
+
+// SiteDiff returns a unified diff between two site config revisions.
+//
+// 🚨 SECURITY: This method does NOT verify the user is an admin. The caller is
+// responsible for ensuring this or that the response never makes it to a user.
+func SiteDiff(ctx context.Context, fromID, toID int32) (result string, err error) {
+	err = runInNewTxn(ctx, func(tx queryable) error {
+		result, err = diff(ctx, tx, typeSite, fromID, toID)
+		return err
+	})
+	return result, err
+}
+
+// CriticalDiff returns a unified diff between two critical config revisions.
+//
+// 🚨 SECURITY: This method does NOT verify the user is an admin. The caller is
+// responsible for ensuring this or that the response never makes it to a user.
+func CriticalDiff(ctx context.Context, fromID, toID int32) (result string, err error) {
+	err = runInNewTxn(ctx, func(tx queryable) error {
+		result, err = diff(ctx, tx, typeCritical, fromID, toID)
+		return err
+	})
+	return result, err
+}
+
+// SiteRollback atomically creates a new site config revision whose contents are
+// equal to those of targetID, recording authorUserID as the author of the rollback.
+//
+// 🚨 SECURITY: This method does NOT verify the user is an admin. The caller is
+// responsible for ensuring this or that the response never makes it to a user.
+func SiteRollback(ctx context.Context, targetID int32, authorUserID int32) (config *SiteConfig, err error) {
+	err = runInNewTxn(ctx, func(tx queryable) error {
+		c, err := rollback(ctx, tx, typeSite, targetID, authorUserID)
+		if err != nil {
+			return err
+		}
+		config = (*SiteConfig)(c)
+		return nil
+	})
+	return config, err
+}
+
+// CriticalRollback atomically creates a new critical config revision whose contents
+// are equal to those of targetID, recording authorUserID as the author of the rollback.
+//
+// 🚨 SECURITY: This method does NOT verify the user is an admin. The caller is
+// responsible for ensuring this or that the response never makes it to a user.
+func CriticalRollback(ctx context.Context, targetID int32, authorUserID int32) (config *CriticalConfig, err error) {
+	err = runInNewTxn(ctx, func(tx queryable) error {
+		c, err := rollback(ctx, tx, typeCritical, targetID, authorUserID)
+		if err != nil {
+			return err
+		}
+		config = (*CriticalConfig)(c)
+		return nil
+	})
+	return config, err
 }
 
 func addDefault(ctx context.Context, tx queryable, configType configType, contents string) (newLastID *int32, err error) {
@@ -154,21 +287,47 @@ func addDefault(ctx context.Context, tx queryable, configType configType, conten
 	}
 
 	// Create the default.
-	latest, err = createIfUpToDate(ctx, tx, configType, nil, contents)
+	latest, err = createIfUpToDate(ctx, tx, configType, nil, nil, "", contents)
 	if err != nil {
 		return nil, err
 	}
 	return &latest.ID, nil
 }
 
-func createIfUpToDate(ctx context.Context, tx queryable, configType configType, lastID *int32, contents string) (latest *Config, err error) {
+func createIfUpToDate(ctx context.Context, tx queryable, configType configType, lastID *int32, authorUserID *int32, message, contents string) (latest *Config, err error) {
+	return createIfUpToDateFromSource(ctx, tx, configType, lastID, authorUserID, message, nil, contents)
+}
+
+// createIfUpToDateFromSource is the same as createIfUpToDate, but additionally
+// records sourceRef (e.g. a git commit SHA) against the new revision when one
+// is created. It is used directly by ConfigSource implementations; ordinary
+// writes go through createIfUpToDate, which always passes a nil sourceRef.
+func createIfUpToDateFromSource(ctx context.Context, tx queryable, configType configType, lastID *int32, authorUserID *int32, message string, sourceRef *string, contents string) (latest *Config, err error) {
 	// Validate JSON syntax before saving.
 	if _, errs := jsonx.Parse(contents, jsonx.ParseOptions{Comments: true, TrailingCommas: true}); len(errs) > 0 {
 		return nil, fmt.Errorf("invalid settings JSON: %v", errs)
 	}
 
+	// Validate against the registered JSON Schema, if any.
+	if validationErr, err := defaultValidator.Validate(configType, contents); err != nil {
+		return nil, err
+	} else if validationErr != nil {
+		return nil, validationErr
+	}
+
+	// Envelope-encrypt any registered secret fields before persisting.
+	// new.Contents (used for the in-memory return value) stays plaintext, to
+	// match what getLatest/getByID return after decrypting on read.
+	storedContents, err := encryptSecrets(ctx, contents)
+	if err != nil {
+		return nil, err
+	}
+
 	new := Config{
-		Contents: contents,
+		Contents:     contents,
+		AuthorUserID: authorUserID,
+		Message:      message,
+		SourceRef:    sourceRef,
 	}
 
 	latest, err = getLatest(ctx, tx, configType)
@@ -178,21 +337,33 @@ func createIfUpToDate(ctx context.Context, tx queryable, configType configType,
 
 	creatorIsUpToDate := latest != nil && lastID != nil && latest.ID == *lastID
 	if latest == nil || creatorIsUpToDate {
+		if latest != nil {
+			new.ParentID = &latest.ID
+		}
 		err := tx.QueryRowContext(
 			ctx,
-			"INSERT INTO critical_and_site_config(type, contents) VALUES($1, $2) RETURNING id, created_at, updated_at",
-			configType, new.Contents,
+			"INSERT INTO critical_and_site_config(type, contents, author_user_id, message, parent_id, source_ref) VALUES($1, $2, $3, $4, $5, $6) RETURNING id, created_at, updated_at",
+			configType, storedContents, new.AuthorUserID, new.Message, new.ParentID, new.SourceRef,
 		).Scan(&new.ID, &new.CreatedAt, &new.UpdatedAt)
 		if err != nil {
 			return nil, err
 		}
+
+		// Notify subscribers in the same transaction so a notification is
+		// only observed once the revision is actually committed.
+		notifyRows, err := tx.QueryContext(ctx, "SELECT pg_notify($1, $2)", channelName(configType), fmt.Sprintf("%d", new.ID))
+		if err != nil {
+			return nil, err
+		}
+		notifyRows.Close()
+
 		latest = &new
 	}
 	return latest, nil
 }
 
 func getLatest(ctx context.Context, tx queryable, configType configType) (*Config, error) {
-	q := sqlf.Sprintf("SELECT s.id, s.type, s.contents, s.created_at, s.updated_at FROM critical_and_site_config s WHERE type=%s ORDER BY id DESC LIMIT 1", configType)
+	q := sqlf.Sprintf("SELECT s.id, s.type, s.contents, s.created_at, s.updated_at, s.author_user_id, s.message, s.parent_id, s.source_ref FROM critical_and_site_config s WHERE type=%s ORDER BY id DESC LIMIT 1", configType)
 	rows, err := tx.QueryContext(ctx, q.Query(sqlf.PostgresBindVar), q.Args()...)
 	if err != nil {
 		return nil, err
@@ -205,15 +376,106 @@ func getLatest(ctx context.Context, tx queryable, configType configType) (*Confi
 		// No config has been written yet.
 		return nil, nil
 	}
+	if err := decryptConfig(ctx, versions[0]); err != nil {
+		return nil, err
+	}
 	return versions[0], nil
 }
 
+// listHistory returns revisions of configType, most recent first, for pagination
+// through the audit trail.
+func listHistory(ctx context.Context, tx queryable, configType configType, limit, offset int) ([]*Config, error) {
+	q := sqlf.Sprintf("SELECT s.id, s.type, s.contents, s.created_at, s.updated_at, s.author_user_id, s.message, s.parent_id, s.source_ref FROM critical_and_site_config s WHERE type=%s ORDER BY id DESC LIMIT %s OFFSET %s", configType, limit, offset)
+	rows, err := tx.QueryContext(ctx, q.Query(sqlf.PostgresBindVar), q.Args()...)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := parseQueryRows(ctx, rows)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range versions {
+		if err := decryptConfig(ctx, v); err != nil {
+			return nil, err
+		}
+	}
+	return versions, nil
+}
+
+// allRevisions returns every revision of configType, oldest first. It is used
+// by maintenance operations (e.g. Rewrap) that must visit the full history
+// rather than a paginated slice of it.
+func allRevisions(ctx context.Context, tx queryable, configType configType) ([]*Config, error) {
+	q := sqlf.Sprintf("SELECT s.id, s.type, s.contents, s.created_at, s.updated_at, s.author_user_id, s.message, s.parent_id, s.source_ref FROM critical_and_site_config s WHERE type=%s ORDER BY id ASC", configType)
+	rows, err := tx.QueryContext(ctx, q.Query(sqlf.PostgresBindVar), q.Args()...)
+	if err != nil {
+		return nil, err
+	}
+	return parseQueryRows(ctx, rows)
+}
+
+// getByID returns the single revision of configType with the given id, or nil if
+// it does not exist.
+func getByID(ctx context.Context, tx queryable, configType configType, id int32) (*Config, error) {
+	q := sqlf.Sprintf("SELECT s.id, s.type, s.contents, s.created_at, s.updated_at, s.author_user_id, s.message, s.parent_id, s.source_ref FROM critical_and_site_config s WHERE type=%s AND id=%s", configType, id)
+	rows, err := tx.QueryContext(ctx, q.Query(sqlf.PostgresBindVar), q.Args()...)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := parseQueryRows(ctx, rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) != 1 {
+		return nil, fmt.Errorf("confdb: no %s config revision with id %d", configType, id)
+	}
+	if err := decryptConfig(ctx, versions[0]); err != nil {
+		return nil, err
+	}
+	return versions[0], nil
+}
+
+// diff returns a unified diff of the contents of the fromID and toID revisions
+// of configType.
+func diff(ctx context.Context, tx queryable, configType configType, fromID, toID int32) (string, error) {
+	from, err := getByID(ctx, tx, configType, fromID)
+	if err != nil {
+		return "", err
+	}
+	to, err := getByID(ctx, tx, configType, toID)
+	if err != nil {
+		return "", err
+	}
+	return unifiedDiff(fmt.Sprintf("%s#%d", configType, fromID), fmt.Sprintf("%s#%d", configType, toID), from.Contents, to.Contents), nil
+}
+
+// rollback atomically creates a new revision of configType whose contents equal
+// those of targetID, so that the rollback itself shows up in the audit trail.
+func rollback(ctx context.Context, tx queryable, configType configType, targetID int32, authorUserID int32) (*Config, error) {
+	target, err := getByID(ctx, tx, configType, targetID)
+	if err != nil {
+		return nil, err
+	}
+
+	latest, err := getLatest(ctx, tx, configType)
+	if err != nil {
+		return nil, err
+	}
+	var lastID *int32
+	if latest != nil {
+		lastID = &latest.ID
+	}
+
+	message := fmt.Sprintf("Rollback to revision %d", targetID)
+	return createIfUpToDate(ctx, tx, configType, lastID, &authorUserID, message, target.Contents)
+}
+
 func parseQueryRows(ctx context.Context, rows *sql.Rows) ([]*Config, error) {
 	versions := []*Config{}
 	defer rows.Close()
 	for rows.Next() {
 		f := Config{}
-		err := rows.Scan(&f.ID, &f.Type, &f.Contents, &f.CreatedAt, &f.UpdatedAt)
+		err := rows.Scan(&f.ID, &f.Type, &f.Contents, &f.CreatedAt, &f.UpdatedAt, &f.AuthorUserID, &f.Message, &f.ParentID, &f.SourceRef)
 		if err != nil {
 			return nil, err
 		}
@@ -239,16 +501,32 @@ const (
 	typeSite     configType = "site"
 )
 
-// SetDefaultConfigs should be invoked once early on in the program
-// startup, before calls to e.g. conf.Get are made. It will panic if called
-// more than once.
-func SetDefaultConfigs(critical, site string) {
+// ConfigType identifies which of the two config documents -- site or
+// critical -- an operation applies to. It is exported for callers of
+// Validate and Subscribe, which (unlike the rest of this package's API)
+// aren't split into separate Site/Critical functions.
+type ConfigType = configType
+
+const (
+	TypeCritical ConfigType = typeCritical
+	TypeSite     ConfigType = typeSite
+)
+
+// SetDefaultConfigs should be invoked once early on in the program startup,
+// before calls to e.g. conf.Get are made. It applies any pending schema
+// migrations before recording the defaults, and will panic if called more
+// than once.
+func SetDefaultConfigs(ctx context.Context, critical, site string) error {
 	if setDefaultConfigsCalled {
 		panic("confdb.SetDefaultConfigs may not be called twice")
 	}
+	if err := schema.Migrate(ctx, dbconn.Global); err != nil {
+		return fmt.Errorf("confdb: migrating schema: %v", err)
+	}
 	setDefaultConfigsCalled = true
 	defaultCriticalConfig = critical
 	defaultSiteConfig = site
+	return nil
 }
 
 var (
@@ -0,0 +1,46 @@
+package confdb
+
+import "testing"
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		a, b     string
+		wantBody string // everything after the --- / +++ header lines
+	}{
+		{
+			name:     "identical",
+			a:        "line1\nline2\n",
+			b:        "line1\nline2\n",
+			wantBody: " line1\n line2\n \n",
+		},
+		{
+			name:     "single line changed",
+			a:        "a\nb\nc\n",
+			b:        "a\nx\nc\n",
+			wantBody: " a\n-b\n+x\n c\n \n",
+		},
+		{
+			name:     "append",
+			a:        "a\n",
+			b:        "a\nb\n",
+			wantBody: " a\n+b\n \n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := unifiedDiff("from", "to", tt.a, tt.b)
+			want := "--- from\n+++ to\n" + tt.wantBody
+			if got != want {
+				t.Errorf("unifiedDiff(%q, %q) =\n%q\nwant\n%q", tt.a, tt.b, got, want)
+			}
+		})
+	}
+}
+
+func TestUnifiedDiff_NoSpuriousChanges(t *testing.T) {
+	contents := `{"a": 1, "b": 2}`
+	if diff := unifiedDiff("from", "to", contents, contents); diff != "--- from\n+++ to\n "+contents+"\n" {
+		t.Errorf("diffing identical contents produced a non-trivial diff: %q", diff)
+	}
+}
@@ -0,0 +1,527 @@
+package confdb
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// stripJSONXFormatting returns src with jsonx comments ("//", "/* */") and
+// trailing commas blanked out (replaced with spaces, never removed), so the
+// result is strict JSON that encoding/json can parse while every remaining
+// byte offset still lines up exactly with src. That offset-preservation is
+// what lets spliceJSONValue locate a value in the stripped copy and cut the
+// same span out of the original, comments and all.
+func stripJSONXFormatting(src string) (string, error) {
+	out := []byte(src)
+	inString := false
+	for i := 0; i < len(out); i++ {
+		c := out[i]
+		switch {
+		case inString:
+			if c == '\\' {
+				i++ // skip the escaped character, whatever it is
+				continue
+			}
+			if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == '/' && i+1 < len(out) && out[i+1] == '/':
+			for i < len(out) && out[i] != '\n' {
+				out[i] = ' '
+				i++
+			}
+		case c == '/' && i+1 < len(out) && out[i+1] == '*':
+			start := i
+			out[i], out[i+1] = ' ', ' '
+			i += 2
+			for i+1 < len(out) && !(out[i] == '*' && out[i+1] == '/') {
+				if out[i] != '\n' {
+					out[i] = ' '
+				}
+				i++
+			}
+			if i+1 >= len(out) {
+				return "", fmt.Errorf("confdb: unterminated comment at offset %d", start)
+			}
+			out[i], out[i+1] = ' ', ' '
+			i++
+		}
+	}
+
+	// Trailing commas are blanked in a second pass, once comments are
+	// already gone, so a comma followed by a now-blanked comment and then a
+	// closing '}'/']' is still recognized as trailing. This pass must track
+	// inString independently: a comma inside a string value (e.g. a
+	// password containing ",") is not a trailing comma and must be left
+	// alone, even though the string's contents are untouched by the pass
+	// above.
+	inString = false
+	for i := 0; i < len(out); i++ {
+		c := out[i]
+		switch {
+		case inString:
+			if c == '\\' {
+				i++
+				continue
+			}
+			if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == ',':
+			for j := i + 1; j < len(out); j++ {
+				switch out[j] {
+				case ' ', '\t', '\n', '\r':
+					continue
+				case '}', ']':
+					out[i] = ' '
+				}
+				break
+			}
+		}
+	}
+	return string(out), nil
+}
+
+// spliceJSONValue returns src with the value at pointer replaced by
+// replacementJSON, leaving every other byte -- comments, whitespace, key
+// order -- untouched. ok is false if pointer doesn't resolve to a value.
+func spliceJSONValue(src, pointer, replacementJSON string) (string, bool, error) {
+	segments := jsonPointerSegments(pointer)
+	if len(segments) == 0 {
+		return src, false, nil
+	}
+	stripped, err := stripJSONXFormatting(src)
+	if err != nil {
+		return "", false, err
+	}
+	start, end, ok, err := locateJSONValue(json.NewDecoder(strings.NewReader(stripped)), segments)
+	if err != nil || !ok {
+		return "", ok, err
+	}
+	return src[:start] + replacementJSON + src[end:], true, nil
+}
+
+// locateJSONValue reads the JSON value dec is currently positioned at and, if
+// the given pointer segments resolve within it, returns the resolved value's
+// byte offsets within dec's input. It stops reading as soon as the value is
+// found or a segment fails to resolve, so dec is not necessarily left
+// positioned after the outer value.
+func locateJSONValue(dec *json.Decoder, segments []string) (start, end int, ok bool, err error) {
+	if len(segments) == 0 {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return 0, 0, false, err
+		}
+		post := int(dec.InputOffset())
+		return post - len(raw), post, true, nil
+	}
+
+	tok, err := dec.Token()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if delim, isDelim := tok.(json.Delim); !isDelim || delim != '{' {
+		return 0, 0, false, nil
+	}
+	for dec.More() {
+		keyTok, err := dec.Token()
+		if err != nil {
+			return 0, 0, false, err
+		}
+		key, _ := keyTok.(string)
+		if key == segments[0] {
+			return locateJSONValue(dec, segments[1:])
+		}
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			return 0, 0, false, err
+		}
+	}
+	return 0, 0, false, nil
+}
+
+// KeyProvider wraps and unwraps data keys using a master key held outside of
+// confdb (e.g. a local key file or a cloud KMS). confdb never persists a
+// master key itself, only data keys wrapped by one.
+type KeyProvider interface {
+	// ActiveKeyID returns the identifier of the master key that should be
+	// used to wrap new data keys.
+	ActiveKeyID(ctx context.Context) (string, error)
+	// Wrap encrypts dataKey with the master key identified by keyID.
+	Wrap(ctx context.Context, keyID string, dataKey []byte) (wrapped []byte, err error)
+	// Unwrap decrypts a data key that was wrapped with the master key
+	// identified by keyID.
+	Unwrap(ctx context.Context, keyID string, wrapped []byte) (dataKey []byte, err error)
+}
+
+// SetKeyProvider registers kp as the provider used to envelope-encrypt secret
+// fields on write and decrypt them on read. It should be called once early
+// in program startup; encryption is disabled (fields are stored in
+// plaintext) until this is called.
+func SetKeyProvider(kp KeyProvider) {
+	activeKeyProvider = kp
+}
+
+// SetSecretPaths registers the JSON pointers (RFC 6901, e.g.
+// "/email.smtp/password") of fields that should be envelope-encrypted before
+// being written to the database, and transparently decrypted on read.
+func SetSecretPaths(paths ...string) {
+	secretPaths = paths
+}
+
+var (
+	activeKeyProvider KeyProvider
+	secretPaths       []string
+)
+
+// encryptedMarker is the JSON object shape a secret field is replaced with
+// once encrypted: the AES-GCM ciphertext, the data key that protects it
+// (itself wrapped by the named master key), and the ID of that master key.
+type encryptedMarker struct {
+	Enc string `json:"$enc"`
+	DK  string `json:"$dk"`
+	Kid string `json:"$kid"`
+}
+
+func (m encryptedMarker) toMap() map[string]interface{} {
+	return map[string]interface{}{"$enc": m.Enc, "$dk": m.DK, "$kid": m.Kid}
+}
+
+func encryptedMarkerFromValue(v interface{}) (encryptedMarker, bool) {
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return encryptedMarker{}, false
+	}
+	enc, _ := obj["$enc"].(string)
+	if enc == "" {
+		return encryptedMarker{}, false
+	}
+	dk, _ := obj["$dk"].(string)
+	kid, _ := obj["$kid"].(string)
+	return encryptedMarker{Enc: enc, DK: dk, Kid: kid}, true
+}
+
+// encryptSecrets returns contents with every registered secret path replaced
+// by its envelope-encrypted form. Everything outside those paths -- comments,
+// trailing commas, formatting, key order -- is preserved byte-for-byte,
+// since confdb's JSON-syntax and schema checks run against contents
+// independently of this step and expect to see it unchanged. If a
+// KeyProvider and secret paths are registered but contents can't even be
+// parsed once comments
+// are stripped, that's an error, not a silent no-op: silently storing a
+// secret in plaintext because it briefly failed to parse is worse than
+// failing the write.
+func encryptSecrets(ctx context.Context, contents string) (string, error) {
+	if activeKeyProvider == nil || len(secretPaths) == 0 {
+		return contents, nil
+	}
+
+	stripped, err := stripJSONXFormatting(contents)
+	if err != nil {
+		return "", fmt.Errorf("confdb: encrypting secret fields: %v", err)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(stripped), &doc); err != nil {
+		return "", fmt.Errorf("confdb: encrypting secret fields: contents is not valid JSON: %v", err)
+	}
+
+	keyID, err := activeKeyProvider.ActiveKeyID(ctx)
+	if err != nil {
+		return "", fmt.Errorf("confdb: getting active key id: %v", err)
+	}
+
+	out := contents
+	changed := false
+	for _, path := range secretPaths {
+		val, ok := jsonPointerGet(doc, path)
+		if !ok || val == nil {
+			continue
+		}
+		if _, alreadyEncrypted := encryptedMarkerFromValue(val); alreadyEncrypted {
+			continue
+		}
+		plaintext, ok := val.(string)
+		if !ok {
+			continue
+		}
+
+		marker, err := encryptValue(ctx, keyID, plaintext)
+		if err != nil {
+			return "", fmt.Errorf("confdb: encrypting %s: %v", path, err)
+		}
+		markerJSON, err := json.Marshal(marker.toMap())
+		if err != nil {
+			return "", err
+		}
+		spliced, ok, err := spliceJSONValue(out, path, string(markerJSON))
+		if err != nil {
+			return "", fmt.Errorf("confdb: encrypting %s: %v", path, err)
+		}
+		if !ok {
+			continue
+		}
+		out = spliced
+		changed = true
+	}
+	if !changed {
+		return contents, nil
+	}
+	return out, nil
+}
+
+// decryptConfig decrypts c.Contents in place.
+func decryptConfig(ctx context.Context, c *Config) error {
+	contents, err := decryptSecrets(ctx, c.Contents)
+	if err != nil {
+		return err
+	}
+	c.Contents = contents
+	return nil
+}
+
+// decryptSecrets reverses encryptSecrets, replacing every registered secret
+// path that holds an encryptedMarker with its decrypted plaintext, splicing
+// each one into place so everything else about contents -- comments,
+// formatting, key order -- is preserved. Fields that aren't encrypted (e.g.
+// because encryption wasn't enabled when they were written) are left as-is.
+func decryptSecrets(ctx context.Context, contents string) (string, error) {
+	if activeKeyProvider == nil || len(secretPaths) == 0 {
+		return contents, nil
+	}
+
+	stripped, err := stripJSONXFormatting(contents)
+	if err != nil {
+		return "", fmt.Errorf("confdb: decrypting secret fields: %v", err)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(stripped), &doc); err != nil {
+		return "", fmt.Errorf("confdb: decrypting secret fields: contents is not valid JSON: %v", err)
+	}
+
+	out := contents
+	changed := false
+	for _, path := range secretPaths {
+		val, ok := jsonPointerGet(doc, path)
+		if !ok {
+			continue
+		}
+		marker, ok := encryptedMarkerFromValue(val)
+		if !ok {
+			continue
+		}
+
+		plaintext, err := decryptValue(ctx, marker)
+		if err != nil {
+			return "", fmt.Errorf("confdb: decrypting %s: %v", path, err)
+		}
+		plaintextJSON, err := json.Marshal(plaintext)
+		if err != nil {
+			return "", err
+		}
+		spliced, ok, err := spliceJSONValue(out, path, string(plaintextJSON))
+		if err != nil {
+			return "", fmt.Errorf("confdb: decrypting %s: %v", path, err)
+		}
+		if !ok {
+			continue
+		}
+		out = spliced
+		changed = true
+	}
+	if !changed {
+		return contents, nil
+	}
+	return out, nil
+}
+
+// Rewrap re-wraps the data key of every encrypted secret field, across every
+// historical revision of both config types, with the currently active master
+// key. It is intended to be run as a maintenance operation after rotating
+// (or planning to retire) a master key; it does not change the underlying
+// AES-GCM ciphertext, only which master key protects the data key that
+// decrypts it.
+func Rewrap(ctx context.Context) error {
+	if activeKeyProvider == nil {
+		return fmt.Errorf("confdb: Rewrap called without a registered KeyProvider")
+	}
+	return runInNewTxn(ctx, func(tx queryable) error {
+		keyID, err := activeKeyProvider.ActiveKeyID(ctx)
+		if err != nil {
+			return err
+		}
+		for _, ct := range []ConfigType{typeSite, typeCritical} {
+			if err := rewrapConfigType(ctx, tx, ct, keyID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func rewrapConfigType(ctx context.Context, tx queryable, configType ConfigType, activeKeyID string) error {
+	revisions, err := allRevisions(ctx, tx, configType)
+	if err != nil {
+		return err
+	}
+	for _, rev := range revisions {
+		rewrapped, changed, err := rewrapContents(ctx, rev.Contents, activeKeyID)
+		if err != nil {
+			return fmt.Errorf("confdb: rewrapping revision %d: %v", rev.ID, err)
+		}
+		if !changed {
+			continue
+		}
+		rows, err := tx.QueryContext(ctx, "UPDATE critical_and_site_config SET contents=$1 WHERE id=$2 RETURNING id", rewrapped, rev.ID)
+		if err != nil {
+			return err
+		}
+		rows.Close()
+	}
+	return nil
+}
+
+func rewrapContents(ctx context.Context, contents string, activeKeyID string) (string, bool, error) {
+	stripped, err := stripJSONXFormatting(contents)
+	if err != nil {
+		return "", false, fmt.Errorf("confdb: rewrapping: %v", err)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(stripped), &doc); err != nil {
+		return "", false, fmt.Errorf("confdb: rewrapping: contents is not valid JSON: %v", err)
+	}
+
+	out := contents
+	changed := false
+	for _, path := range secretPaths {
+		val, ok := jsonPointerGet(doc, path)
+		if !ok {
+			continue
+		}
+		marker, ok := encryptedMarkerFromValue(val)
+		if !ok || marker.Kid == activeKeyID {
+			continue
+		}
+
+		wrapped, err := base64.StdEncoding.DecodeString(marker.DK)
+		if err != nil {
+			return "", false, err
+		}
+		dataKey, err := activeKeyProvider.Unwrap(ctx, marker.Kid, wrapped)
+		if err != nil {
+			return "", false, err
+		}
+		rewrappedDK, err := activeKeyProvider.Wrap(ctx, activeKeyID, dataKey)
+		if err != nil {
+			return "", false, err
+		}
+		marker.DK = base64.StdEncoding.EncodeToString(rewrappedDK)
+		marker.Kid = activeKeyID
+
+		markerJSON, err := json.Marshal(marker.toMap())
+		if err != nil {
+			return "", false, err
+		}
+		spliced, ok, err := spliceJSONValue(out, path, string(markerJSON))
+		if err != nil {
+			return "", false, fmt.Errorf("confdb: rewrapping %s: %v", path, err)
+		}
+		if !ok {
+			continue
+		}
+		out = spliced
+		changed = true
+	}
+	if !changed {
+		return contents, false, nil
+	}
+	return out, true, nil
+}
+
+func encryptValue(ctx context.Context, keyID, plaintext string) (encryptedMarker, error) {
+	dataKey := make([]byte, 32) // AES-256
+	if _, err := rand.Read(dataKey); err != nil {
+		return encryptedMarker{}, err
+	}
+
+	ciphertext, err := aesGCMSeal(dataKey, []byte(plaintext))
+	if err != nil {
+		return encryptedMarker{}, err
+	}
+
+	wrappedDK, err := activeKeyProvider.Wrap(ctx, keyID, dataKey)
+	if err != nil {
+		return encryptedMarker{}, err
+	}
+
+	return encryptedMarker{
+		Enc: base64.StdEncoding.EncodeToString(ciphertext),
+		DK:  base64.StdEncoding.EncodeToString(wrappedDK),
+		Kid: keyID,
+	}, nil
+}
+
+func decryptValue(ctx context.Context, marker encryptedMarker) (string, error) {
+	wrappedDK, err := base64.StdEncoding.DecodeString(marker.DK)
+	if err != nil {
+		return "", err
+	}
+	dataKey, err := activeKeyProvider.Unwrap(ctx, marker.Kid, wrappedDK)
+	if err != nil {
+		return "", err
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(marker.Enc)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := aesGCMOpen(dataKey, ciphertext)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// jsonPointerGet resolves an RFC 6901 JSON pointer (e.g. "/email.smtp/password")
+// against doc, returning ok=false if any segment along the path is missing.
+// Only object members are followed: a segment that would index into an array
+// (or any other non-object) also yields ok=false.
+func jsonPointerGet(doc map[string]interface{}, pointer string) (interface{}, bool) {
+	segments := jsonPointerSegments(pointer)
+	if len(segments) == 0 {
+		return nil, false
+	}
+	var cur interface{} = doc
+	for _, seg := range segments {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		cur, ok = m[seg]
+		if !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+func jsonPointerSegments(pointer string) []string {
+	if pointer == "" || pointer == "/" {
+		return nil
+	}
+	parts := strings.Split(strings.TrimPrefix(pointer, "/"), "/")
+	for i, p := range parts {
+		p = strings.ReplaceAll(p, "~1", "/")
+		p = strings.ReplaceAll(p, "~0", "~")
+		parts[i] = p
+	}
+	return parts
+}
@@ -0,0 +1,144 @@
+package confdb
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// fakeKeyProvider is an in-memory KeyProvider for tests: it "wraps" data keys
+// by sealing them with a single fixed AES-256 key, so tests don't need a real
+// KMS or key file.
+type fakeKeyProvider struct {
+	keyID string
+	key   []byte
+}
+
+func newFakeKeyProvider() *fakeKeyProvider {
+	return &fakeKeyProvider{keyID: "test-key-1", key: []byte("01234567890123456789012345678901")[:32]}
+}
+
+func (p *fakeKeyProvider) ActiveKeyID(ctx context.Context) (string, error) { return p.keyID, nil }
+
+func (p *fakeKeyProvider) Wrap(ctx context.Context, keyID string, dataKey []byte) ([]byte, error) {
+	return aesGCMSeal(p.key, dataKey)
+}
+
+func (p *fakeKeyProvider) Unwrap(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	return aesGCMOpen(p.key, wrapped)
+}
+
+// withKeyProvider registers kp and paths for the duration of a test, and
+// restores the previous (nil) globals on cleanup.
+func withKeyProvider(t *testing.T, kp KeyProvider, paths ...string) {
+	t.Helper()
+	activeKeyProvider, secretPaths = kp, paths
+	t.Cleanup(func() {
+		activeKeyProvider, secretPaths = nil, nil
+	})
+}
+
+func TestStripJSONXFormatting_OffsetPreserving(t *testing.T) {
+	src := `{
+  // a comment
+  "a": 1, /* inline */
+  "b": [1, 2, 3,],
+}`
+	stripped, err := stripJSONXFormatting(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stripped) != len(src) {
+		t.Fatalf("length changed: got %d want %d", len(stripped), len(src))
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(stripped), &v); err != nil {
+		t.Fatalf("stripped output is not valid JSON: %v\n%s", err, stripped)
+	}
+}
+
+func TestStripJSONXFormatting_CommaInStringPreserved(t *testing.T) {
+	// Regression test: a "," immediately before a "}"/"]" inside a string
+	// value (e.g. an admin-entered secret) must not be mistaken for a
+	// trailing comma and blanked out.
+	src := `{"email.smtp":{"password":"p,}w"}}`
+	stripped, err := stripJSONXFormatting(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(stripped), &doc); err != nil {
+		t.Fatalf("stripped output is not valid JSON: %v\n%s", err, stripped)
+	}
+	got := doc["email.smtp"].(map[string]interface{})["password"]
+	if got != "p,}w" {
+		t.Fatalf("comma inside string value was corrupted: got %q, want %q", got, "p,}w")
+	}
+}
+
+func TestStripJSONXFormatting_TrailingCommaBeforeComment(t *testing.T) {
+	src := "{\"a\":1, // trailing note\n}"
+	stripped, err := stripJSONXFormatting(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(stripped), &v); err != nil {
+		t.Fatalf("stripped output is not valid JSON: %v\n%s", err, stripped)
+	}
+}
+
+func TestEncryptDecryptSecrets_RoundTrip(t *testing.T) {
+	withKeyProvider(t, newFakeKeyProvider(), "/email.smtp/password")
+
+	contents := `{
+  // SMTP settings
+  "email.smtp": {
+    "host": "smtp.example.com",
+    "password": "p,}w" // a tricky secret
+  },
+}`
+
+	ctx := context.Background()
+	encrypted, err := encryptSecrets(ctx, contents)
+	if err != nil {
+		t.Fatalf("encryptSecrets: %v", err)
+	}
+	if strings.Contains(encrypted, `"p,}w"`) {
+		t.Fatalf("secret was not encrypted:\n%s", encrypted)
+	}
+	if !strings.Contains(encrypted, "// SMTP settings") || !strings.Contains(encrypted, "// a tricky secret") {
+		t.Fatalf("comments were not preserved:\n%s", encrypted)
+	}
+
+	decrypted, err := decryptSecrets(ctx, encrypted)
+	if err != nil {
+		t.Fatalf("decryptSecrets: %v", err)
+	}
+	if !strings.Contains(decrypted, `"password": "p,}w"`) {
+		t.Fatalf("secret did not round-trip:\n%s", decrypted)
+	}
+	if !strings.Contains(decrypted, "// SMTP settings") {
+		t.Fatalf("comments were not preserved after decrypt:\n%s", decrypted)
+	}
+}
+
+func TestEncryptSecrets_ErrorsOnUnparseableJSON(t *testing.T) {
+	withKeyProvider(t, newFakeKeyProvider(), "/email.smtp/password")
+
+	if _, err := encryptSecrets(context.Background(), `{not json`); err == nil {
+		t.Fatal("expected an error for unparseable contents, got nil")
+	}
+}
+
+func TestEncryptSecrets_NoopWithoutKeyProvider(t *testing.T) {
+	contents := `{"email.smtp": {"password": "hunter2"}}`
+	got, err := encryptSecrets(context.Background(), contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != contents {
+		t.Fatalf("expected contents to pass through unchanged, got %q", got)
+	}
+}
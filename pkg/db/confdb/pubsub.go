@@ -0,0 +1,163 @@
+package confdb
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Subscribe registers for notifications about new revisions of configType,
+// so callers no longer need to poll SiteGetLatest/CriticalGetLatest to
+// detect edits made elsewhere (e.g. by another frontend replica).
+//
+// The returned channel receives the latest Config each time a new revision
+// is committed. Sends are coalescing and non-blocking: a slow consumer that
+// hasn't drained the channel only ever sees the most recent revision, never
+// a backlog of stale ones. The returned unsubscribe function must be called
+// once the caller is done to release the subscription.
+func Subscribe(ctx context.Context, configType ConfigType) (<-chan *Config, func()) {
+	startListener()
+
+	sub := &subscription{ch: make(chan *Config, 1)}
+	subMu.Lock()
+	subscribers[configType] = append(subscribers[configType], sub)
+	subMu.Unlock()
+
+	unsubscribe := func() {
+		subMu.Lock()
+		defer subMu.Unlock()
+		subs := subscribers[configType]
+		for i, s := range subs {
+			if s == sub {
+				subscribers[configType] = append(subs[:i], subs[i+1:]...)
+				break
+			}
+		}
+	}
+	return sub.ch, unsubscribe
+}
+
+type subscription struct {
+	ch chan *Config
+}
+
+var (
+	subMu        sync.Mutex
+	subscribers  = map[ConfigType][]*subscription{}
+	listenerOnce sync.Once
+)
+
+// startListener lazily starts the package-level LISTEN goroutine the first
+// time anyone calls Subscribe; most processes that link confdb never
+// subscribe, so there's no reason to hold a LISTEN connection open for them.
+func startListener() {
+	listenerOnce.Do(func() {
+		go runListener()
+	})
+}
+
+func runListener() {
+	// An empty DSN makes lib/pq fall back to the standard libpq environment
+	// variables (PGHOST, PGUSER, ...), the same ones dbconn.Global connects
+	// with. pq.Listener reconnects on its own with exponential backoff
+	// between minReconnectInterval and maxReconnectInterval if the
+	// connection drops.
+	const (
+		minReconnectInterval = 10 * time.Second
+		maxReconnectInterval = time.Minute
+	)
+	listener := pq.NewListener("", minReconnectInterval, maxReconnectInterval, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("confdb: pubsub listener: %v", err)
+		}
+	})
+	defer listener.Close()
+
+	for _, ct := range []ConfigType{typeSite, typeCritical} {
+		if err := listener.Listen(channelName(ct)); err != nil {
+			log.Printf("confdb: failed to LISTEN on %s: %v", channelName(ct), err)
+		}
+	}
+
+	for n := range listener.Notify {
+		if n == nil {
+			// A reconnection occurred; any writes that happened while we
+			// were disconnected will simply be picked up by the next one.
+			continue
+		}
+		handleNotification(n)
+	}
+}
+
+func handleNotification(n *pq.Notification) {
+	configType := configTypeFromChannel(n.Channel)
+	if configType == "" {
+		return
+	}
+	id, err := strconv.Atoi(n.Extra)
+	if err != nil {
+		log.Printf("confdb: ignoring malformed notification payload %q on %s", n.Extra, n.Channel)
+		return
+	}
+
+	ctx := context.Background()
+	var cfg *Config
+	err = runInNewTxn(ctx, func(tx queryable) error {
+		c, err := getByID(ctx, tx, configType, int32(id))
+		if err != nil {
+			return err
+		}
+		cfg = c
+		return nil
+	})
+	if err != nil {
+		log.Printf("confdb: fetching notified revision %d: %v", id, err)
+		return
+	}
+
+	notifySubscribers(configType, cfg)
+}
+
+// notifySubscribers fans cfg out to every subscriber of configType, without
+// blocking on a slow consumer: a subscriber whose channel is still holding a
+// previous value has that value dropped in favor of cfg, since only the
+// latest revision matters to a caller that hasn't caught up yet. Split out
+// from handleNotification so this behavior is testable without a live
+// Postgres LISTEN connection.
+func notifySubscribers(configType ConfigType, cfg *Config) {
+	subMu.Lock()
+	defer subMu.Unlock()
+	for _, sub := range subscribers[configType] {
+		select {
+		case sub.ch <- cfg:
+		default:
+			// Coalesce: drop whatever stale value is buffered in favor of
+			// the latest one.
+			select {
+			case <-sub.ch:
+			default:
+			}
+			sub.ch <- cfg
+		}
+	}
+}
+
+func channelName(configType ConfigType) string {
+	return fmt.Sprintf("confdb_%s", configType)
+}
+
+func configTypeFromChannel(channel string) ConfigType {
+	switch channel {
+	case channelName(typeSite):
+		return typeSite
+	case channelName(typeCritical):
+		return typeCritical
+	default:
+		return ""
+	}
+}
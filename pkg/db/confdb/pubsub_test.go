@@ -0,0 +1,72 @@
+package confdb
+
+import "testing"
+
+// resetSubscribers clears package-level subscriber state before a test runs,
+// so tests don't interfere with each other via the shared subscribers map.
+func resetSubscribers(t *testing.T) {
+	t.Helper()
+	subMu.Lock()
+	subscribers = map[ConfigType][]*subscription{}
+	subMu.Unlock()
+}
+
+func TestNotifySubscribers_Coalesces(t *testing.T) {
+	resetSubscribers(t)
+	sub := &subscription{ch: make(chan *Config, 1)}
+	subscribers[typeSite] = []*subscription{sub}
+
+	notifySubscribers(typeSite, &Config{ID: 1})
+	notifySubscribers(typeSite, &Config{ID: 2})
+	notifySubscribers(typeSite, &Config{ID: 3})
+
+	select {
+	case got := <-sub.ch:
+		if got.ID != 3 {
+			t.Fatalf("got ID %d, want 3 (only the latest revision should survive)", got.ID)
+		}
+	default:
+		t.Fatal("expected a coalesced value on the channel")
+	}
+
+	select {
+	case got := <-sub.ch:
+		t.Fatalf("expected only one coalesced value, got a second: %+v", got)
+	default:
+	}
+}
+
+func TestNotifySubscribers_DoesNotBlock(t *testing.T) {
+	resetSubscribers(t)
+	sub := &subscription{ch: make(chan *Config, 1)}
+	subscribers[typeSite] = []*subscription{sub}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			notifySubscribers(typeSite, &Config{ID: int32(i)})
+		}
+		close(done)
+	}()
+	<-done // would hang forever if notifySubscribers ever blocked on a full channel
+}
+
+func TestNotifySubscribers_FansOutToMultiple(t *testing.T) {
+	resetSubscribers(t)
+	a := &subscription{ch: make(chan *Config, 1)}
+	b := &subscription{ch: make(chan *Config, 1)}
+	subscribers[typeCritical] = []*subscription{a, b}
+
+	notifySubscribers(typeCritical, &Config{ID: 42})
+
+	for _, sub := range []*subscription{a, b} {
+		select {
+		case got := <-sub.ch:
+			if got.ID != 42 {
+				t.Fatalf("got ID %d, want 42", got.ID)
+			}
+		default:
+			t.Fatal("expected both subscribers to receive the notification")
+		}
+	}
+}
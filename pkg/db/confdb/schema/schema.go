@@ -0,0 +1,224 @@
+// Package schema manages versioned DDL for the critical_and_site_config
+// table. Each schema_N.sql / migration_N_M.sql file in this directory is
+// mirrored below as a Go string constant so it can be applied without a
+// separate asset-generation step; keep the two in sync when editing either.
+package schema
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"sort"
+)
+
+// CurrentVersion is the schema version this binary expects the database to be
+// at once Migrate has run.
+const CurrentVersion = 2
+
+// schema1 creates the critical_and_site_config table as it existed before
+// confdb tracked revision history.
+const schema1 = `
+CREATE TABLE IF NOT EXISTS critical_and_site_config (
+    id SERIAL PRIMARY KEY,
+    type TEXT NOT NULL,
+    contents TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS critical_and_site_config_type_idx ON critical_and_site_config (type);
+`
+
+// migration1To2 adds the columns needed for the config history/audit trail
+// (author_user_id, message, parent_id) and for ConfigSource ingestion
+// (source_ref).
+const migration1To2 = `
+ALTER TABLE critical_and_site_config
+    ADD COLUMN IF NOT EXISTS author_user_id INTEGER,
+    ADD COLUMN IF NOT EXISTS message TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS parent_id INTEGER REFERENCES critical_and_site_config (id),
+    ADD COLUMN IF NOT EXISTS source_ref TEXT;
+`
+
+// column describes one column as it should appear in information_schema.columns
+// once its introducing migration has been applied. dataType must match
+// Postgres's information_schema.columns.data_type spelling exactly (e.g.
+// "timestamp with time zone", not "timestamptz"), since that's what LiveHash
+// compares against.
+type column struct {
+	table    string
+	column   string
+	dataType string
+}
+
+// migrations lists every schema change in order. version is the schema
+// version the database is at once ddl has been applied. columns lists every
+// column introduced by ddl, used by ExpectedHash to compute a hash in the
+// same representation LiveHash computes from the live database -- hashing
+// the DDL text itself would never match a hash of the live schema.
+var migrations = []struct {
+	version int
+	ddl     string
+	columns []column
+}{
+	{
+		version: 1,
+		ddl:     schema1,
+		columns: []column{
+			{"critical_and_site_config", "id", "integer"},
+			{"critical_and_site_config", "type", "text"},
+			{"critical_and_site_config", "contents", "text"},
+			{"critical_and_site_config", "created_at", "timestamp with time zone"},
+			{"critical_and_site_config", "updated_at", "timestamp with time zone"},
+			{"confdb_schema_version", "version", "integer"},
+		},
+	},
+	{
+		version: 2,
+		ddl:     migration1To2,
+		columns: []column{
+			{"critical_and_site_config", "author_user_id", "integer"},
+			{"critical_and_site_config", "message", "text"},
+			{"critical_and_site_config", "parent_id", "integer"},
+			{"critical_and_site_config", "source_ref", "text"},
+		},
+	},
+}
+
+// Migrate brings the database schema up to CurrentVersion, applying any
+// pending migrations in order inside a single transaction. It refuses to
+// start if the database's recorded schema version is newer than
+// CurrentVersion, since that means the running binary is older than the
+// schema it is connecting to.
+func Migrate(ctx context.Context, db *sql.DB) (err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	if err := ensureMetadataTable(ctx, tx); err != nil {
+		return err
+	}
+
+	current, err := currentVersion(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if current > CurrentVersion {
+		return fmt.Errorf("confdb/schema: database schema is at version %d, but this binary only supports up to version %d (it is older than the database) - upgrade it before continuing", current, CurrentVersion)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, m.ddl); err != nil {
+			return fmt.Errorf("confdb/schema: applying migration to version %d: %v", m.version, err)
+		}
+		if err := setVersion(ctx, tx, m.version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ensureMetadataTable(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+CREATE TABLE IF NOT EXISTS confdb_schema_version (
+    version INTEGER NOT NULL
+);`)
+	return err
+}
+
+func currentVersion(ctx context.Context, tx *sql.Tx) (int, error) {
+	var version int
+	err := tx.QueryRowContext(ctx, "SELECT version FROM confdb_schema_version LIMIT 1").Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return version, err
+}
+
+func setVersion(ctx context.Context, tx *sql.Tx, version int) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM confdb_schema_version"); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, "INSERT INTO confdb_schema_version (version) VALUES ($1)", version)
+	return err
+}
+
+// ExpectedHash returns the sha256 hash (hex-encoded) of the column set that
+// should exist once every migration up to and including version has been
+// applied. It's computed in exactly the representation LiveHash uses for the
+// live database, so the two are comparable.
+func ExpectedHash(version int) (string, error) {
+	var columns []column
+	found := false
+	for _, m := range migrations {
+		if m.version > version {
+			break
+		}
+		found = true
+		columns = append(columns, m.columns...)
+	}
+	if !found {
+		return "", fmt.Errorf("confdb/schema: unknown schema version %d", version)
+	}
+	return hashColumns(columns), nil
+}
+
+// LiveHash computes a hash of the live critical_and_site_config and
+// confdb_schema_version table definitions, in the same representation
+// ExpectedHash uses, by hashing their column names and types as reported by
+// information_schema.
+func LiveHash(ctx context.Context, db *sql.DB) (string, error) {
+	rows, err := db.QueryContext(ctx, `
+SELECT table_name, column_name, data_type
+FROM information_schema.columns
+WHERE table_name IN ('critical_and_site_config', 'confdb_schema_version')`)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var columns []column
+	for rows.Next() {
+		var c column
+		if err := rows.Scan(&c.table, &c.column, &c.dataType); err != nil {
+			return "", err
+		}
+		columns = append(columns, c)
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	return hashColumns(columns), nil
+}
+
+// hashColumns hashes columns in a stable order, independent of the order
+// they were supplied in, so ExpectedHash (built up migration-by-migration)
+// and LiveHash (returned in whatever order Postgres lists them) agree.
+func hashColumns(columns []column) string {
+	sorted := make([]column, len(columns))
+	copy(sorted, columns)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].table != sorted[j].table {
+			return sorted[i].table < sorted[j].table
+		}
+		return sorted[i].column < sorted[j].column
+	})
+
+	h := sha256.New()
+	for _, c := range sorted {
+		fmt.Fprintf(h, "%s.%s:%s\n", c.table, c.column, c.dataType)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
@@ -0,0 +1,167 @@
+package confdb
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ConfigSource is a pluggable external source of critical/site config
+// contents. It allows configuration to be authored outside of the admin UI
+// (e.g. in a git repository) and ingested into confdb as new revisions.
+type ConfigSource interface {
+	// Start runs the source's sync loop. It blocks until ctx is canceled or an
+	// unrecoverable error occurs.
+	Start(ctx context.Context) error
+}
+
+// Precedence controls how a ConfigSource reconciles a DB-local edit (made
+// directly through the admin UI) with the most recently synced revision from
+// the external source when both have advanced since the last sync.
+type Precedence string
+
+const (
+	// PrecedenceGitWins always applies the external source's contents,
+	// overwriting any DB-local edit made since the last sync.
+	PrecedenceGitWins Precedence = "git-wins"
+	// PrecedenceDBWins keeps the DB-local edit: while the latest revision
+	// is a DB-local edit (one with no SourceRef), the external source's
+	// contents are not applied, and the skipped commit is not retried.
+	PrecedenceDBWins Precedence = "db-wins"
+	// PrecedenceReadOnlyGit behaves like PrecedenceGitWins, and additionally
+	// documents that callers should prevent direct DB-local edits entirely
+	// (confdb itself does not enforce this).
+	PrecedenceReadOnlyGit Precedence = "read-only-git"
+)
+
+// GitFetcher retrieves config file contents from a remote git repository. It
+// is an interface so GitConfigSource's polling loop can be exercised without
+// depending on an actual git remote or the git binary.
+type GitFetcher interface {
+	// ResolveHead returns the commit SHA that branch currently points to.
+	ResolveHead(ctx context.Context, url, branch string) (sha string, err error)
+	// FetchFile returns the contents of path as of sha, or ("", nil) if path
+	// does not exist at that commit.
+	FetchFile(ctx context.Context, url, sha, path string) (contents string, err error)
+}
+
+// GitConfigSource periodically polls a remote git repository for site/critical
+// config files and ingests each new commit as a confdb revision, recording the
+// git SHA as the revision's SourceRef.
+//
+// This mirrors the follower pattern used by git-backed ingestion tooling
+// elsewhere: a background goroutine on a poll interval, a local pointer
+// (here, the last-seen SHA, held in memory) into the source of truth, and
+// idempotent ingestion so that restarts don't duplicate rows.
+type GitConfigSource struct {
+	URL          string        // the remote git repository to poll
+	Branch       string        // the branch to follow
+	SitePath     string        // path to site.json within the repository, if tracked
+	CriticalPath string        // path to critical.json within the repository, if tracked
+	PollInterval time.Duration // defaults to 30s if zero
+	Precedence   Precedence    // defaults to PrecedenceGitWins if empty
+
+	// AuthorUserID is attributed to revisions created from this source. It
+	// is typically a reserved system user id.
+	AuthorUserID *int32
+
+	Fetcher GitFetcher
+
+	mu      sync.Mutex
+	lastSHA string
+}
+
+// Start implements ConfigSource.
+func (s *GitConfigSource) Start(ctx context.Context) error {
+	interval := s.PollInterval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.poll(ctx); err != nil {
+			log.Printf("confdb: GitConfigSource poll of %s failed: %v", s.URL, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *GitConfigSource) poll(ctx context.Context) error {
+	sha, err := s.Fetcher.ResolveHead(ctx, s.URL, s.Branch)
+	if err != nil {
+		return fmt.Errorf("resolving HEAD of %s@%s: %v", s.URL, s.Branch, err)
+	}
+
+	s.mu.Lock()
+	unchanged := sha == s.lastSHA
+	s.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	if s.SitePath != "" {
+		if err := s.ingest(ctx, typeSite, sha, s.SitePath); err != nil {
+			return err
+		}
+	}
+	if s.CriticalPath != "" {
+		if err := s.ingest(ctx, typeCritical, sha, s.CriticalPath); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	s.lastSHA = sha
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *GitConfigSource) ingest(ctx context.Context, configType configType, sha, path string) error {
+	contents, err := s.Fetcher.FetchFile(ctx, s.URL, sha, path)
+	if err != nil {
+		return fmt.Errorf("fetching %s at %s: %v", path, sha, err)
+	}
+
+	return runInNewTxn(ctx, func(tx queryable) error {
+		latest, err := getLatest(ctx, tx, configType)
+		if err != nil {
+			return err
+		}
+
+		if latest != nil && latest.SourceRef != nil && *latest.SourceRef == sha {
+			// Already ingested this commit as the latest revision -- most
+			// likely we're re-polling it after a restart, since poll's
+			// in-memory lastSHA doesn't survive one. Re-running
+			// createIfUpToDateFromSource here would create a duplicate,
+			// no-op revision on every restart.
+			return nil
+		}
+
+		precedence := s.Precedence
+		if precedence == "" {
+			precedence = PrecedenceGitWins
+		}
+		if precedence == PrecedenceDBWins && latest != nil && latest.SourceRef == nil {
+			// A DB-local edit is newer than the last sync; leave it in place
+			// and don't apply this commit.
+			return nil
+		}
+
+		var lastID *int32
+		if latest != nil {
+			lastID = &latest.ID
+		}
+		message := fmt.Sprintf("Synced from %s@%s", s.URL, sha)
+		_, err = createIfUpToDateFromSource(ctx, tx, configType, lastID, s.AuthorUserID, message, &sha, contents)
+		return err
+	})
+}
@@ -0,0 +1,82 @@
+package confdb
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/lib/pq"
+
+	"github.com/sourcegraph/sourcegraph/pkg/db/dbconn"
+)
+
+// maxTxnAttempts bounds how many attempts in all (the first try included)
+// runInNewTxn makes at a transaction that fails with a retryable Postgres
+// error.
+var maxTxnAttempts = 5
+
+// pgErrSerializationFailure is raised when a SERIALIZABLE transaction can't be
+// committed because of a conflict with a concurrent transaction.
+const pgErrSerializationFailure = "40001"
+
+// pgErrDeadlockDetected is raised when the transaction was one of the victims
+// of a deadlock.
+const pgErrDeadlockDetected = "40P01"
+
+// runInNewTxn opens a new SERIALIZABLE transaction, invokes fn, and commits.
+// If fn (or the commit) fails with a retryable Postgres error -- a
+// serialization failure or a deadlock, both of which are expected to occur
+// under concurrent admin edits -- the transaction is rolled back and retried
+// with exponential backoff, for at most maxTxnAttempts attempts in all.
+func runInNewTxn(ctx context.Context, fn func(tx queryable) error) error {
+	backoff := 10 * time.Millisecond
+	var err error
+	for attempt := 0; attempt < maxTxnAttempts; attempt++ {
+		err = runTxnOnce(ctx, fn)
+		if err == nil || !isRetryablePgError(err) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	return err
+}
+
+func runTxnOnce(ctx context.Context, fn func(tx queryable) error) (err error) {
+	rtx, err := dbconn.Global.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			rollErr := rtx.Rollback()
+			if rollErr != nil {
+				err = multierror.Append(err, rollErr)
+			}
+			return
+		}
+		err = rtx.Commit()
+	}()
+
+	err = fn(rtx)
+	return err
+}
+
+func isRetryablePgError(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	if !ok {
+		return false
+	}
+	switch pqErr.Code {
+	case pgErrSerializationFailure, pgErrDeadlockDetected:
+		return true
+	default:
+		return false
+	}
+}
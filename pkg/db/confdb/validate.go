@@ -0,0 +1,117 @@
+package confdb
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// Severity classifies how serious a validation problem is.
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// ValidationProblem describes a single issue found while validating config
+// contents against its JSON Schema, in a form the frontend can use to
+// highlight the offending region inline.
+type ValidationProblem struct {
+	JSONPath string
+	Line     int // 0 if unknown; the schema validator installed by SetSchemas always leaves it 0
+	Column   int // 0 if unknown; the schema validator installed by SetSchemas always leaves it 0
+	Message  string
+	Severity Severity
+}
+
+// ValidationError is returned when contents is syntactically valid JSON but
+// fails schema validation. It carries every problem found, not just the
+// first, so the frontend can highlight them all inline.
+type ValidationError struct {
+	Problems []ValidationProblem
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Problems) == 0 {
+		return "confdb: config failed validation"
+	}
+	msg := fmt.Sprintf("confdb: config failed validation: %s", e.Problems[0].Message)
+	if extra := len(e.Problems) - 1; extra > 0 {
+		msg += fmt.Sprintf(" (and %d more problem(s))", extra)
+	}
+	return msg
+}
+
+// Validator validates config contents beyond plain JSON syntax.
+type Validator interface {
+	Validate(configType ConfigType, contents string) (*ValidationError, error)
+}
+
+// SetSchemas registers the JSON Schemas used to validate critical/site config
+// contents on every write. It should be called once early in program
+// startup, typically alongside SetDefaultConfigs. Passing an empty schema for
+// a config type disables validation for it.
+func SetSchemas(critical, site string) {
+	defaultValidator = &schemaValidator{criticalSchema: critical, siteSchema: site}
+}
+
+// Validate checks contents against the registered JSON Schema for
+// configType, without writing it. The returned *ValidationError is nil if
+// contents is valid (or no schema is registered for configType); err is
+// non-nil for failures other than schema violations, e.g. a malformed schema
+// or contents that cannot be parsed as JSON at all.
+func Validate(ctx context.Context, configType ConfigType, contents string) (*ValidationError, error) {
+	return defaultValidator.Validate(configType, contents)
+}
+
+var defaultValidator Validator = noopValidator{}
+
+// noopValidator is used until SetSchemas is called, so writes aren't
+// rejected by default in environments (e.g. tests) that never register
+// schemas.
+type noopValidator struct{}
+
+func (noopValidator) Validate(ConfigType, string) (*ValidationError, error) { return nil, nil }
+
+type schemaValidator struct {
+	criticalSchema string
+	siteSchema     string
+}
+
+func (v *schemaValidator) Validate(configType ConfigType, contents string) (*ValidationError, error) {
+	schemaJSON := v.siteSchema
+	if configType == TypeCritical {
+		schemaJSON = v.criticalSchema
+	}
+	if schemaJSON == "" {
+		return nil, nil
+	}
+
+	// contents is allowed to have jsonx comments and trailing commas (see
+	// the syntax check in createIfUpToDateFromSource), but gojsonschema only
+	// accepts strict JSON, so strip those before handing it off.
+	stripped, err := stripJSONXFormatting(contents)
+	if err != nil {
+		return nil, fmt.Errorf("confdb: validating %s config against its schema: %v", configType, err)
+	}
+
+	result, err := gojsonschema.Validate(gojsonschema.NewStringLoader(schemaJSON), gojsonschema.NewStringLoader(stripped))
+	if err != nil {
+		return nil, fmt.Errorf("confdb: validating %s config against its schema: %v", configType, err)
+	}
+	if result.Valid() {
+		return nil, nil
+	}
+
+	problems := make([]ValidationProblem, 0, len(result.Errors()))
+	for _, re := range result.Errors() {
+		problems = append(problems, ValidationProblem{
+			JSONPath: re.Field(),
+			Message:  re.Description(),
+			Severity: SeverityError,
+		})
+	}
+	return &ValidationError{Problems: problems}, nil
+}